@@ -2,17 +2,19 @@ package chimera
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	admissionv1 "k8s.io/api/admission/v1"
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
@@ -22,34 +24,102 @@ import (
 	kubeclient "sigs.k8s.io/controller-runtime/pkg/client/config"
 )
 
+// WebhookCallback is the legacy validating webhook signature. Prefer
+// WebhookCallbackWithContext, whose ctx carries a request-scoped Logger
+// (see LoggerFromContext); AdaptWebhookCallback wraps a WebhookCallback for
+// use wherever a WebhookCallbackWithContext is expected.
 type WebhookCallback func(*admissionv1.AdmissionRequest) (WebhookResponse, error)
 
+// WebhookCallbackWithContext is the ctx-aware validating webhook signature.
+// BuildHandler calls it with a ctx carrying a Logger (retrievable with
+// LoggerFromContext) already scoped with the request's uid, kind,
+// namespace, name, and operation.
+type WebhookCallbackWithContext func(ctx context.Context, req *admissionv1.AdmissionRequest) (WebhookResponse, error)
+
+// AdaptWebhookCallback wraps a legacy WebhookCallback so it can be assigned
+// to Webhook.Callback, ignoring the ctx it's passed.
+func AdaptWebhookCallback(callback WebhookCallback) WebhookCallbackWithContext {
+	return func(_ context.Context, req *admissionv1.AdmissionRequest) (WebhookResponse, error) {
+		return callback(req)
+	}
+}
+
+// defaultTimeoutSeconds is used for a webhook's TimeoutSeconds when left
+// unset, conservative enough to avoid stalling admission of unrelated
+// objects if a callback hangs.
+const defaultTimeoutSeconds = int32(10)
+
 type Webhook struct {
-	Rules         []admissionregistrationv1.RuleWithOperations
-	Callback      WebhookCallback
-	FailurePolicy admissionregistrationv1.FailurePolicyType // +optional
-	Name          string                                    // +optional
-	Path          string                                    // +optional
+	Rules             []admissionregistrationv1.RuleWithOperations
+	Callback          WebhookCallbackWithContext
+	FailurePolicy     admissionregistrationv1.FailurePolicyType // +optional
+	Name              string                                    // +optional
+	Path              string                                    // +optional
+	NamespaceSelector *metav1.LabelSelector                     // +optional
+	ObjectSelector    *metav1.LabelSelector                     // +optional
+	TimeoutSeconds    *int32                                    // +optional, defaults to 10
+	MatchPolicy       *admissionregistrationv1.MatchPolicyType  // +optional
 }
 
 type WebhookList []Webhook
 
+// MutatingWebhookCallback is the legacy mutating counterpart to
+// WebhookCallback: in addition to allowing or rejecting the request, it may
+// return a JSONPatch describing how the admitted object should be changed.
+// Prefer MutatingWebhookCallbackWithContext; AdaptMutatingWebhookCallback
+// wraps a MutatingWebhookCallback for use wherever it's expected.
+type MutatingWebhookCallback func(*admissionv1.AdmissionRequest) (MutatingResponse, error)
+
+// MutatingWebhookCallbackWithContext is the ctx-aware mutating webhook
+// signature. BuildHandler calls it with a ctx carrying a Logger (retrievable
+// with LoggerFromContext) already scoped with the request's uid, kind,
+// namespace, name, and operation.
+type MutatingWebhookCallbackWithContext func(ctx context.Context, req *admissionv1.AdmissionRequest) (MutatingResponse, error)
+
+// AdaptMutatingWebhookCallback wraps a legacy MutatingWebhookCallback so it
+// can be assigned to MutatingWebhook.Callback, ignoring the ctx it's passed.
+func AdaptMutatingWebhookCallback(callback MutatingWebhookCallback) MutatingWebhookCallbackWithContext {
+	return func(_ context.Context, req *admissionv1.AdmissionRequest) (MutatingResponse, error) {
+		return callback(req)
+	}
+}
+
+type MutatingWebhook struct {
+	Rules              []admissionregistrationv1.RuleWithOperations
+	Callback           MutatingWebhookCallbackWithContext
+	FailurePolicy      admissionregistrationv1.FailurePolicyType       // +optional
+	Name               string                                          // +optional
+	Path               string                                          // +optional
+	NamespaceSelector  *metav1.LabelSelector                           // +optional
+	ObjectSelector     *metav1.LabelSelector                           // +optional
+	TimeoutSeconds     *int32                                          // +optional, defaults to 10
+	MatchPolicy        *admissionregistrationv1.MatchPolicyType        // +optional
+	ReinvocationPolicy *admissionregistrationv1.ReinvocationPolicyType // +optional
+}
+
+type MutatingWebhookList []MutatingWebhook
+
 func internalServerError(log Logger, w http.ResponseWriter, err error) {
 	log.Errorf("Internal server error: %v", err)
 	w.WriteHeader(http.StatusInternalServerError)
 }
 
-func performValidation(callback WebhookCallback, log Logger, w http.ResponseWriter, r *http.Request) {
+func performValidation(webhookName string, callback WebhookCallbackWithContext, m *metrics, log Logger, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	body, _ := ioutil.ReadAll(r.Body)
 	log.Debugf("Validating request: %s", string(body))
 	admissionReview := admissionv1.AdmissionReview{}
 	err := json.Unmarshal(body, &admissionReview)
 	if err != nil {
+		m.observeError(webhookName, "decode")
 		internalServerError(log, w, err)
 		return
 	}
-	webhookResponse, err := callback(admissionReview.Request)
+	operation := string(admissionReview.Request.Operation)
+	ctx := ContextWithLogger(r.Context(), requestScopedLogger(log, admissionReview.Request))
+	webhookResponse, err := callback(ctx, admissionReview.Request)
 	if err != nil {
+		m.observeError(webhookName, "callback")
 		internalServerError(log, w, err)
 		return
 	}
@@ -64,18 +134,96 @@ func performValidation(callback WebhookCallback, log Logger, w http.ResponseWrit
 	if webhookResponse.RejectionMessage != nil {
 		admissionResponse.Result.Message = *webhookResponse.RejectionMessage
 	}
+	admissionResponse.Result.Reason = webhookResponse.Reason
+	admissionResponse.Result.Details = webhookResponse.Details
+	admissionResponse.Warnings = webhookResponse.Warnings
+	admissionResponse.AuditAnnotations = webhookResponse.AuditAnnotations
 	admissionReview.Response = &admissionResponse
 	marshaledAdmissionReview, err := json.Marshal(admissionReview)
 	if err != nil {
+		m.observeError(webhookName, "encode")
 		internalServerError(log, w, err)
 		return
 	}
+	m.observeRequest(webhookName, operation, webhookResponse.Allowed, time.Since(start))
 	log.Debugf("Validation response: %s", string(marshaledAdmissionReview))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(marshaledAdmissionReview)
 }
 
+func performMutation(webhookName string, callback MutatingWebhookCallbackWithContext, m *metrics, log Logger, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	body, _ := ioutil.ReadAll(r.Body)
+	log.Debugf("Mutating request: %s", string(body))
+	admissionReview := admissionv1.AdmissionReview{}
+	err := json.Unmarshal(body, &admissionReview)
+	if err != nil {
+		m.observeError(webhookName, "decode")
+		internalServerError(log, w, err)
+		return
+	}
+	operation := string(admissionReview.Request.Operation)
+	ctx := ContextWithLogger(r.Context(), requestScopedLogger(log, admissionReview.Request))
+	mutatingResponse, err := callback(ctx, admissionReview.Request)
+	if err != nil {
+		m.observeError(webhookName, "callback")
+		internalServerError(log, w, err)
+		return
+	}
+	admissionResponse := admissionv1.AdmissionResponse{
+		UID:     admissionReview.Request.UID,
+		Allowed: mutatingResponse.Allowed,
+		Result:  &metav1.Status{},
+	}
+	if mutatingResponse.Code != nil {
+		admissionResponse.Result.Code = *mutatingResponse.Code
+	}
+	if mutatingResponse.RejectionMessage != nil {
+		admissionResponse.Result.Message = *mutatingResponse.RejectionMessage
+	}
+	admissionResponse.Result.Reason = mutatingResponse.Reason
+	admissionResponse.Result.Details = mutatingResponse.Details
+	admissionResponse.Warnings = mutatingResponse.Warnings
+	admissionResponse.AuditAnnotations = mutatingResponse.AuditAnnotations
+	if mutatingResponse.Allowed && len(mutatingResponse.Patch) > 0 {
+		patch, err := json.Marshal(mutatingResponse.Patch)
+		if err != nil {
+			m.observeError(webhookName, "encode")
+			internalServerError(log, w, err)
+			return
+		}
+		patchType := admissionv1.PatchTypeJSONPatch
+		admissionResponse.PatchType = &patchType
+		admissionResponse.Patch = patch
+	}
+	admissionReview.Response = &admissionResponse
+	marshaledAdmissionReview, err := json.Marshal(admissionReview)
+	if err != nil {
+		m.observeError(webhookName, "encode")
+		internalServerError(log, w, err)
+		return
+	}
+	m.observeRequest(webhookName, operation, mutatingResponse.Allowed, time.Since(start))
+	log.Debugf("Mutation response: %s", string(marshaledAdmissionReview))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaledAdmissionReview)
+}
+
+// requestScopedLogger derives a Logger scoped to req's uid, kind, namespace,
+// name, and operation, so every line it logs while handling this request is
+// already tagged with the fields operators need to correlate them.
+func requestScopedLogger(log Logger, req *admissionv1.AdmissionRequest) Logger {
+	return requestScopedLoggerWithFields(log, map[string]interface{}{
+		"uid":       string(req.UID),
+		"kind":      req.Kind.Kind,
+		"namespace": req.Namespace,
+		"name":      req.Name,
+		"operation": string(req.Operation),
+	})
+}
+
 func (webhooks WebhookList) asValidatingAdmissionRegistration(admissionConfig *AdmissionConfig, caBundle []byte) admissionregistrationv1.ValidatingWebhookConfiguration {
 	res := admissionregistrationv1.ValidatingWebhookConfiguration{
 		ObjectMeta: metav1.ObjectMeta{
@@ -117,6 +265,9 @@ func (webhooks WebhookList) asValidatingAdmissionRegistration(admissionConfig *A
 			Rules:                   webhook.Rules,
 			SideEffects:             &sideEffects,
 			AdmissionReviewVersions: []string{"v1"},
+			NamespaceSelector:       webhook.NamespaceSelector,
+			ObjectSelector:          webhook.ObjectSelector,
+			MatchPolicy:             webhook.MatchPolicy,
 		}
 		if validatingWebhook.Name == "" {
 			validatingWebhook.Name = fmt.Sprintf("rule-%d", i)
@@ -126,6 +277,12 @@ func (webhooks WebhookList) asValidatingAdmissionRegistration(admissionConfig *A
 		} else {
 			validatingWebhook.FailurePolicy = &webhook.FailurePolicy
 		}
+		if webhook.TimeoutSeconds != nil {
+			validatingWebhook.TimeoutSeconds = webhook.TimeoutSeconds
+		} else {
+			timeoutSeconds := defaultTimeoutSeconds
+			validatingWebhook.TimeoutSeconds = &timeoutSeconds
+		}
 		validatingWebhook.Name = fmt.Sprintf(
 			"%s.%s",
 			validatingWebhook.Name,
@@ -135,32 +292,145 @@ func (webhooks WebhookList) asValidatingAdmissionRegistration(admissionConfig *A
 	return res
 }
 
-func setupAdmissionWebhooks(admissionConfig *AdmissionConfig) {
-	var log Logger
+func (webhooks MutatingWebhookList) asMutatingAdmissionRegistration(admissionConfig *AdmissionConfig, caBundle []byte) admissionregistrationv1.MutatingWebhookConfiguration {
+	res := admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: admissionConfig.Name,
+		},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{},
+	}
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	for i := 0; i < len(admissionConfig.MutatingWebhooks); i++ {
+		webhook := admissionConfig.MutatingWebhooks[i]
+		webhookPath := webhook.Path
+		admissionCallbackURL := url.URL{
+			Scheme: "https",
+			Host: net.JoinHostPort(
+				admissionConfig.CallbackHost,
+				strconv.Itoa(admissionConfig.CallbackPort)),
+			Path: webhook.Path,
+		}
+		admissionCallback := admissionCallbackURL.String()
+
+		clientConfig := admissionregistrationv1.WebhookClientConfig{
+			CABundle: caBundle,
+		}
+		if admissionConfig.KubeNamespace != "" && admissionConfig.KubeService != "" {
+			port := int32(admissionConfig.CallbackPort)
+			clientConfig.Service = &admissionregistrationv1.ServiceReference{
+				Namespace: admissionConfig.KubeNamespace,
+				Name:      admissionConfig.KubeService,
+				Path:      &webhookPath,
+				Port:      &port,
+			}
+		} else {
+			clientConfig.URL = &admissionCallback
+		}
+
+		mutatingWebhook := admissionregistrationv1.MutatingWebhook{
+			Name:                    webhook.Name,
+			ClientConfig:            clientConfig,
+			Rules:                   webhook.Rules,
+			SideEffects:             &sideEffects,
+			AdmissionReviewVersions: []string{"v1"},
+			NamespaceSelector:       webhook.NamespaceSelector,
+			ObjectSelector:          webhook.ObjectSelector,
+			MatchPolicy:             webhook.MatchPolicy,
+			ReinvocationPolicy:      webhook.ReinvocationPolicy,
+		}
+		if mutatingWebhook.Name == "" {
+			mutatingWebhook.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if webhook.FailurePolicy == "" {
+			mutatingWebhook.FailurePolicy = nil
+		} else {
+			mutatingWebhook.FailurePolicy = &webhook.FailurePolicy
+		}
+		if webhook.TimeoutSeconds != nil {
+			mutatingWebhook.TimeoutSeconds = webhook.TimeoutSeconds
+		} else {
+			timeoutSeconds := defaultTimeoutSeconds
+			mutatingWebhook.TimeoutSeconds = &timeoutSeconds
+		}
+		mutatingWebhook.Name = fmt.Sprintf(
+			"%s.%s",
+			mutatingWebhook.Name,
+			admissionConfig.Name)
+		res.Webhooks = append(res.Webhooks, mutatingWebhook)
+	}
+	return res
+}
+
+func loggerFor(admissionConfig *AdmissionConfig) Logger {
 	if admissionConfig.Log == nil {
-		log = &simpleLogger{}
-	} else {
-		log = admissionConfig.Log
+		return &simpleLogger{}
 	}
+	return admissionConfig.Log
+}
+
+// BuildHandler returns an http.ServeMux with each of config's webhooks wired
+// to its validating or mutating callback. Unlike StartServer, it does not
+// own a listener: callers can mount the returned handler under an existing
+// controller-runtime manager.Manager's webhook server, a shared port that
+// also serves /healthz or /metrics, or any other http.Server of their own.
+func BuildHandler(config *AdmissionConfig) (http.Handler, error) {
+	log := loggerFor(config)
+	mux := http.NewServeMux()
 
-	for _, webhook := range admissionConfig.Webhooks {
+	var m *metrics
+	if config.MetricsRegistry != nil {
+		m = newMetrics(config.MetricsRegistry)
+		if gatherer, ok := config.MetricsRegistry.(prometheus.Gatherer); ok {
+			mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+		}
+	}
+
+	wrap := func(h http.HandlerFunc) http.HandlerFunc {
+		if config.ClientAuth == nil {
+			return h
+		}
+		return config.ClientAuth.requireClientCommonName(h)
+	}
+
+	for i := range config.Webhooks {
+		webhook := &config.Webhooks[i]
 		if webhook.Path == "" {
 			webhook.Path = generateValidatePath()
 		}
-		http.HandleFunc(webhook.Path, func(w http.ResponseWriter, r *http.Request) {
-			performValidation(webhook.Callback, log, w, r)
-		})
+		webhookName := webhook.Name
+		if webhookName == "" {
+			webhookName = webhook.Path
+		}
+		mux.HandleFunc(webhook.Path, wrap(func(w http.ResponseWriter, r *http.Request) {
+			performValidation(webhookName, webhook.Callback, m, log, w, r)
+		}))
 	}
-}
 
-func registerAdmissionWebhooks(admissionConfig *AdmissionConfig, caCertificate []byte) error {
-	var log Logger
-	if admissionConfig.Log == nil {
-		log = &simpleLogger{}
-	} else {
-		log = admissionConfig.Log
+	for i := range config.MutatingWebhooks {
+		webhook := &config.MutatingWebhooks[i]
+		if webhook.Path == "" {
+			webhook.Path = generateMutatePath()
+		}
+		webhookName := webhook.Name
+		if webhookName == "" {
+			webhookName = webhook.Path
+		}
+		mux.HandleFunc(webhook.Path, wrap(func(w http.ResponseWriter, r *http.Request) {
+			performMutation(webhookName, webhook.Callback, m, log, w, r)
+		}))
 	}
 
+	return mux, nil
+}
+
+// RegisterWithAPIServer installs config's Validating/MutatingWebhookConfiguration
+// objects against the cluster's apiserver, trusting caBundle (PEM-encoded)
+// for callbacks. Unlike StartServer, it does not generate or manage any
+// certificate material itself, so it can be driven by a caller that owns its
+// own CertProvider or CertStore.
+func RegisterWithAPIServer(ctx context.Context, config *AdmissionConfig, caBundle []byte) error {
+	log := loggerFor(config)
+
 	kubeCfg, err := kubeclient.GetConfig()
 	if err != nil {
 		return err
@@ -169,14 +439,48 @@ func registerAdmissionWebhooks(admissionConfig *AdmissionConfig, caCertificate [
 	if err != nil {
 		return err
 	}
-	caBundle, err := pemEncodeCertificate(caCertificate)
-	if err != nil {
-		return err
+
+	if len(config.Webhooks) > 0 {
+		if err := registerValidatingWebhookConfiguration(ctx, clientset, config, caBundle, log); err != nil {
+			return err
+		}
 	}
+	if len(config.MutatingWebhooks) > 0 {
+		if err := registerMutatingWebhookConfiguration(ctx, clientset, config, caBundle, log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerRetryBackoff is how long registerValidatingWebhookConfiguration
+// and registerMutatingWebhookConfiguration wait between registration
+// attempts against an apiserver that keeps rejecting them.
+const registerRetryBackoff = 5 * time.Second
+
+// waitToRetryRegistration pauses for registerRetryBackoff, or returns
+// ctx.Err() immediately if ctx is cancelled first -- so an embedding caller
+// (e.g. a controller-runtime manager.Manager) can stop a registration loop
+// that can't reach the apiserver instead of it spinning forever.
+func waitToRetryRegistration(ctx context.Context) error {
+	timer := time.NewTimer(registerRetryBackoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func registerValidatingWebhookConfiguration(ctx context.Context, clientset kubernetes.Interface, admissionConfig *AdmissionConfig, caBundle []byte, log Logger) error {
 	webhookCfg := admissionConfig.Webhooks.asValidatingAdmissionRegistration(admissionConfig, caBundle)
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		err := clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Delete(
-			context.TODO(),
+			ctx,
 			admissionConfig.Name,
 			metav1.DeleteOptions{},
 		)
@@ -184,7 +488,7 @@ func registerAdmissionWebhooks(admissionConfig *AdmissionConfig, caCertificate [
 			log.Errorf("Could not cleanup webhook prior to start: %v", err)
 		}
 		webhookList, err := clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().List(
-			context.TODO(),
+			ctx,
 			metav1.ListOptions{},
 		)
 		if err == nil {
@@ -198,7 +502,7 @@ func registerAdmissionWebhooks(admissionConfig *AdmissionConfig, caCertificate [
 			log.Errorf("Could not list current validation webhooks: %v\n", err)
 		}
 		_, err = clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Create(
-			context.TODO(),
+			ctx,
 			&webhookCfg,
 			metav1.CreateOptions{},
 		)
@@ -210,6 +514,57 @@ func registerAdmissionWebhooks(admissionConfig *AdmissionConfig, caCertificate [
 			break
 		}
 		log.Errorf("could not register webhook: %v", err)
+		if err := waitToRetryRegistration(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func registerMutatingWebhookConfiguration(ctx context.Context, clientset kubernetes.Interface, admissionConfig *AdmissionConfig, caBundle []byte, log Logger) error {
+	webhookCfg := admissionConfig.MutatingWebhooks.asMutatingAdmissionRegistration(admissionConfig, caBundle)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Delete(
+			ctx,
+			admissionConfig.Name,
+			metav1.DeleteOptions{},
+		)
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Errorf("Could not cleanup mutating webhook prior to start: %v", err)
+		}
+		webhookList, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().List(
+			ctx,
+			metav1.ListOptions{},
+		)
+		if err == nil {
+			if len(webhookList.Items) != 0 {
+				log.Infof("WARNING: there are %d mutating webhook(s) already registered besides this admission that could mutate requests:\n", len(webhookList.Items))
+				for _, webhook := range webhookList.Items {
+					log.Debugf("  - %s\n", webhook.ObjectMeta.Name)
+				}
+			}
+		} else {
+			log.Errorf("Could not list current mutating webhooks: %v\n", err)
+		}
+		_, err = clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Create(
+			ctx,
+			&webhookCfg,
+			metav1.CreateOptions{},
+		)
+		if err == nil {
+			log.Infof(
+				"mutating webhook for admission %q correctly installed -- %d hook(s) active for this admission",
+				admissionConfig.Name,
+				len(admissionConfig.MutatingWebhooks))
+			break
+		}
+		log.Errorf("could not register mutating webhook: %v", err)
+		if err := waitToRetryRegistration(ctx); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -218,6 +573,10 @@ func generateValidatePath() string {
 	return fmt.Sprintf("/validate-%s", uuid.New().String())
 }
 
+func generateMutatePath() string {
+	return fmt.Sprintf("/mutate-%s", uuid.New().String())
+}
+
 type AdmissionConfig struct {
 	Name                      string
 	KubeNamespace             string
@@ -225,112 +584,157 @@ type AdmissionConfig struct {
 	CallbackHost              string
 	CallbackPort              int
 	Webhooks                  WebhookList
+	MutatingWebhooks          MutatingWebhookList
 	TLSExtraSANs              []string
 	CertFile                  string
 	KeyFile                   string
 	CaFile                    string
+	CertStore                 CertStore         // +optional, defaults to NewInMemoryStore(); use NewSecretStore for HA deployments
+	ClientAuth                *ClientAuthConfig // +optional, enforces mTLS against the apiserver's client identity
 	SkipAdmissionRegistration bool
 	Log                       Logger
+	MetricsRegistry           prometheus.Registerer // +optional, records chimera_admission_* metrics and exposes /metrics when set
 }
 
+// StartServer is a thin wrapper around BuildHandler, newCertProvider and
+// RegisterWithAPIServer that owns the listener itself: it builds the mux,
+// generates or loads serving certificates, registers the webhook
+// configurations, and blocks serving traffic. Callers that want to embed
+// chimera into an existing server -- e.g. a controller-runtime
+// manager.Manager's webhook server, or a port shared with /healthz and
+// /metrics -- should call BuildHandler and RegisterWithAPIServer directly
+// instead.
 func StartServer(config *AdmissionConfig, insecure bool) error {
 	if config.CallbackHost == "" {
 		config.CallbackHost = "localhost"
 	}
 
-	var caCertFile, certFile, keyFile string
-	if config.CertFile != "" && config.KeyFile != "" {
-		certFile = config.CertFile
-		keyFile = config.KeyFile
-		caCertFile = config.CaFile
-	} else {
-		var err error
-		caCertFile, certFile, keyFile, err = automaticCertGeneration(
-			config.CallbackHost,
-			config.TLSExtraSANs)
+	log := loggerFor(config)
 
-		if err != nil {
-			return err
-		}
-		defer os.Remove(caCertFile)
-		defer os.Remove(keyFile)
-		defer os.Remove(certFile)
+	handler, err := BuildHandler(config)
+	if err != nil {
+		return err
 	}
 
-	setupAdmissionWebhooks(config)
+	certProvider, caCertDER, err := newCertProvider(config, log)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	if !config.SkipAdmissionRegistration {
-		caBundle, err := ioutil.ReadFile(caCertFile)
+		caBundle, err := pemEncodeCertificate(caCertDER)
 		if err != nil {
 			return err
 		}
-		if err := registerAdmissionWebhooks(config, caBundle); err != nil {
+		if err := RegisterWithAPIServer(ctx, config, caBundle); err != nil {
 			return err
 		}
+		onCARotate := func(caCertDER []byte) {
+			caBundle, err := pemEncodeCertificate(caCertDER)
+			if err != nil {
+				log.Errorf("failed to PEM-encode rotated CA certificate: %v", err)
+				return
+			}
+			if len(config.Webhooks) > 0 {
+				if err := updateValidatingWebhookCABundle(config, caBundle); err != nil {
+					log.Errorf("failed to update ValidatingWebhookConfiguration CABundle: %v", err)
+				}
+			}
+			if len(config.MutatingWebhooks) > 0 {
+				if err := updateMutatingWebhookCABundle(config, caBundle); err != nil {
+					log.Errorf("failed to update MutatingWebhookConfiguration CABundle: %v", err)
+				}
+			}
+		}
+		switch provider := certProvider.(type) {
+		case *fileCertProvider:
+			provider.onCARotate = onCARotate
+		case *selfSignedCertProvider:
+			provider.onCARotate = onCARotate
+		}
 	}
 
 	if insecure {
 		fmt.Printf("Starting HTTP server on :%d\n", config.CallbackPort)
-		return http.ListenAndServe(fmt.Sprintf(":%d", config.CallbackPort), nil)
-	} else {
-		fmt.Printf("Starting TLS server on :%d - using key: %s, cert %s, CABundle %s\n",
-			config.CallbackPort, keyFile, certFile, caCertFile)
+		return http.ListenAndServe(fmt.Sprintf(":%d", config.CallbackPort), handler)
+	}
 
-		return http.ListenAndServeTLS(fmt.Sprintf(":%d", config.CallbackPort), certFile, keyFile, nil)
+	// onCARotate, if any, must be wired up before the rotation goroutine
+	// starts, since both it and Run's rotation loop touch the field and
+	// only the latter is synchronized by happens-before of the goroutine
+	// start itself.
+	if runner, ok := certProvider.(interface{ Run(context.Context) }); ok {
+		go runner.Run(ctx)
 	}
-}
 
-func automaticCertGeneration(callbackHost string, extraSANs []string) (string, string, string, error) {
-	caCert, CAPrivateKey, err := generateCA()
-	if err != nil {
-		return "", "", "", errors.Errorf("failed to generate CA certificate: %v", err)
+	tlsConfig := &tls.Config{
+		GetCertificate: certProvider.GetCertificate,
+	}
+	if config.ClientAuth != nil {
+		clientCAs, err := config.ClientAuth.certPool()
+		if err != nil {
+			return err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = clientCAs
 	}
 
-	servingCert, servingKey, err := generateCert(
-		caCert,
-		callbackHost,
-		extraSANs,
-		CAPrivateKey.Key())
-	if err != nil {
-		return "", "", "", errors.Errorf("failed to generate serving certificate: %v", err)
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", config.CallbackPort),
+		Handler:   handler,
+		TLSConfig: tlsConfig,
 	}
+	fmt.Printf("Starting TLS server on :%d\n", config.CallbackPort)
+	return server.ListenAndServeTLS("", "")
+}
 
-	caCertFile, err := ioutil.TempFile("", "validating-webhook-ca*.crt")
+// updateValidatingWebhookCABundle pushes the PEM-encoded caBundle onto every
+// webhook in the already-registered ValidatingWebhookConfiguration via
+// Update, rather than deleting and recreating the object, so admissions
+// in flight against the old cert aren't dropped mid-rotation.
+func updateValidatingWebhookCABundle(admissionConfig *AdmissionConfig, caBundle []byte) error {
+	kubeCfg, err := kubeclient.GetConfig()
 	if err != nil {
-		return "", "", "", err
+		return err
 	}
-	certFile, err := ioutil.TempFile("", "validating-webhook-*.crt")
+	clientset, err := kubernetes.NewForConfig(kubeCfg)
 	if err != nil {
-		defer os.Remove(caCertFile.Name())
-		return "", "", "", err
+		return err
 	}
-	keyFile, err := ioutil.TempFile("", "validating-webhook-*.key")
+	client := clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	webhookCfg, err := client.Get(context.TODO(), admissionConfig.Name, metav1.GetOptions{})
 	if err != nil {
-		defer os.Remove(caCertFile.Name())
-		defer os.Remove(certFile.Name())
-		return "", "", "", err
+		return err
 	}
-
-	if err := ioutil.WriteFile(caCertFile.Name(), caCert, 0644); err != nil {
-		defer os.Remove(caCertFile.Name())
-		defer os.Remove(certFile.Name())
-		defer os.Remove(keyFile.Name())
-		return "", "", "", err
+	for i := range webhookCfg.Webhooks {
+		webhookCfg.Webhooks[i].ClientConfig.CABundle = caBundle
 	}
+	_, err = client.Update(context.TODO(), webhookCfg, metav1.UpdateOptions{})
+	return err
+}
 
-	if err := ioutil.WriteFile(certFile.Name(), servingCert, 0644); err != nil {
-		defer os.Remove(caCertFile.Name())
-		defer os.Remove(certFile.Name())
-		defer os.Remove(keyFile.Name())
-		return "", "", "", err
+// updateMutatingWebhookCABundle is the MutatingWebhookConfiguration
+// counterpart to updateValidatingWebhookCABundle.
+func updateMutatingWebhookCABundle(admissionConfig *AdmissionConfig, caBundle []byte) error {
+	kubeCfg, err := kubeclient.GetConfig()
+	if err != nil {
+		return err
 	}
-	if err := ioutil.WriteFile(keyFile.Name(), servingKey, 0600); err != nil {
-		defer os.Remove(caCertFile.Name())
-		defer os.Remove(certFile.Name())
-		defer os.Remove(keyFile.Name())
-		return "", "", "", err
+	clientset, err := kubernetes.NewForConfig(kubeCfg)
+	if err != nil {
+		return err
 	}
-
-	return caCertFile.Name(), certFile.Name(), keyFile.Name(), nil
-
+	client := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	webhookCfg, err := client.Get(context.TODO(), admissionConfig.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range webhookCfg.Webhooks {
+		webhookCfg.Webhooks[i].ClientConfig.CABundle = caBundle
+	}
+	_, err = client.Update(context.TODO(), webhookCfg, metav1.UpdateOptions{})
+	return err
 }
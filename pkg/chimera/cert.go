@@ -12,6 +12,53 @@ import (
 	"time"
 )
 
+// caPrivateKey wraps the private key backing a generated CA certificate so
+// callers can hand it to generateCert without reaching into the x509
+// internals directly.
+type caPrivateKey struct {
+	key *rsa.PrivateKey
+}
+
+func (k *caPrivateKey) Key() *rsa.PrivateKey {
+	return k.key
+}
+
+// caValidity is how long a self-signed CA generated by generateCA is valid
+// for. It is deliberately long-lived relative to the serving certificates
+// chained off of it, which are rotated well before this expires.
+const caValidity = 10 * 365 * 24 * time.Hour
+
+func generateCA() ([]byte, *caPrivateKey, error) {
+	serialNumber, err := rand.Int(rand.Reader, (&big.Int{}).Exp(big.NewInt(2), big.NewInt(159), nil))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName: "chimera-admission-ca",
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(caValidity),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	caCert, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return caCert, &caPrivateKey{key: privateKey}, nil
+}
+
 func generateCert(ca []byte, host string, extraSANs []string, CAPrivateKey *rsa.PrivateKey) ([]byte, []byte, error) {
 	caCertificate, err := x509.ParseCertificate(ca)
 	if err != nil {
@@ -0,0 +1,398 @@
+package chimera
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// CertProvider supplies the serving certificate chimera presents on each TLS
+// handshake. Implementations may swap the underlying keypair at any time;
+// GetCertificate always returns whichever one is currently active, so
+// rotating certificates never drops an in-flight admission request.
+type CertProvider interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// rotateAtFraction is how far into a certificate's validity window chimera
+// generates its replacement, mirroring controller-runtime's
+// dynamiccertificates package.
+const rotateAtFraction = 2.0 / 3.0
+
+// newCertProvider builds the CertProvider StartServer should use for
+// config: a fileCertProvider when the caller supplied CertFile/KeyFile, or a
+// self-signed, in-memory selfSignedCertProvider otherwise. It returns the
+// provider along with the CA bundle (DER-encoded) webhook registration
+// should trust.
+func newCertProvider(config *AdmissionConfig, log Logger) (CertProvider, []byte, error) {
+	if config.CertFile != "" && config.KeyFile != "" {
+		provider, err := newFileCertProvider(config.CertFile, config.KeyFile, config.CaFile, log)
+		if err != nil {
+			return nil, nil, err
+		}
+		return provider, provider.CACertificateDER(), nil
+	}
+
+	store := config.CertStore
+	if store == nil {
+		store = NewInMemoryStore()
+	}
+
+	provider, err := newSelfSignedCertProvider(config.CallbackHost, config.TLSExtraSANs, store, log)
+	if err != nil {
+		return nil, nil, err
+	}
+	return provider, provider.CACertificateDER(), nil
+}
+
+// selfSignedCertProvider keeps a CA and serving keypair in memory and
+// regenerates the serving certificate at rotateAtFraction of its validity
+// window, or immediately on SIGHUP. It replaces the previous
+// automaticCertGeneration tempfile dance and the 1-year hard cap that came
+// with loading the cert into http.ListenAndServeTLS once. Generation and
+// persistence of the underlying material is delegated to a CertStore, which
+// is what lets multiple replicas behind the same Service converge on
+// identical certificates.
+type selfSignedCertProvider struct {
+	host      string
+	extraSANs []string
+	store     CertStore
+	log       Logger
+
+	caCertDER []byte
+	caKey     *rsa.PrivateKey
+
+	current atomic.Value // *tls.Certificate
+
+	// onCARotate, if set, is called with the DER-encoded CA certificate
+	// whenever the store hands back material signed by a different CA than
+	// the one this provider was last serving, so callers can push the new
+	// CABundle onto an already-registered Validating/MutatingWebhookConfiguration
+	// instead of recreating it.
+	onCARotate func(caCertDER []byte)
+}
+
+func newSelfSignedCertProvider(host string, extraSANs []string, store CertStore, log Logger) (*selfSignedCertProvider, error) {
+	p := &selfSignedCertProvider{
+		host:      host,
+		extraSANs: extraSANs,
+		store:     store,
+		log:       log,
+	}
+	if err := p.rotateServingCert(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *selfSignedCertProvider) CACertificateDER() []byte {
+	return p.caCertDER
+}
+
+func (p *selfSignedCertProvider) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return p.current.Load().(*tls.Certificate), nil
+}
+
+// rotateServingCert asks the store for current certificate material,
+// generating fresh material (reusing the existing CA unless it is itself
+// expiring) when the store has none to offer, and adopts whatever material
+// the store ultimately settles on -- which, for a shared store, may be
+// material a peer generated concurrently.
+func (p *selfSignedCertProvider) rotateServingCert() error {
+	material, ok, err := p.store.Load()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		material, err = p.generateMaterial()
+		if err != nil {
+			return err
+		}
+		material, err = p.store.Save(material)
+		if err != nil {
+			return err
+		}
+	}
+	return p.adopt(material)
+}
+
+// generateMaterial mints a fresh serving certificate, reusing this
+// provider's current CA unless it is nil or expiring soon, in which case a
+// new CA is generated too.
+func (p *selfSignedCertProvider) generateMaterial() (*CertMaterial, error) {
+	caCertDER := p.caCertDER
+	caKey := p.caKey
+	if caCertDER == nil || certNeedsRotation(caCertDER) {
+		freshCACertDER, caPrivateKey, err := generateCA()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate CA certificate: %w", err)
+		}
+		caCertDER = freshCACertDER
+		caKey = caPrivateKey.Key()
+	}
+
+	servingCertPEM, servingKeyPEM, err := generateCert(caCertDER, p.host, p.extraSANs, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serving certificate: %w", err)
+	}
+
+	caKeyPEM, err := pemEncodePrivateKey(x509.MarshalPKCS1PrivateKey(caKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertMaterial{
+		CACertDER:      caCertDER,
+		CAKeyPEM:       caKeyPEM,
+		ServingCertPEM: servingCertPEM,
+		ServingKeyPEM:  servingKeyPEM,
+	}, nil
+}
+
+func (p *selfSignedCertProvider) adopt(material *CertMaterial) error {
+	cert, err := tls.X509KeyPair(material.ServingCertPEM, material.ServingKeyPEM)
+	if err != nil {
+		return err
+	}
+	caKey, err := parsePKCS1PrivateKeyPEM(material.CAKeyPEM)
+	if err != nil {
+		return err
+	}
+
+	rotatedCA := p.caCertDER != nil && !bytes.Equal(p.caCertDER, material.CACertDER)
+	p.caCertDER = material.CACertDER
+	p.caKey = caKey
+	p.current.Store(&cert)
+
+	if rotatedCA && p.onCARotate != nil {
+		p.onCARotate(material.CACertDER)
+	}
+	return nil
+}
+
+func (p *selfSignedCertProvider) nextRotation() time.Duration {
+	leaf := leafOf(p.current.Load().(*tls.Certificate))
+	if leaf == nil {
+		return time.Hour
+	}
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	rotateAt := leaf.NotBefore.Add(time.Duration(float64(lifetime) * rotateAtFraction))
+	if d := time.Until(rotateAt); d > time.Minute {
+		return d
+	}
+	return time.Minute
+}
+
+// Run regenerates the serving certificate shortly before it expires, or
+// immediately whenever the process receives SIGHUP, until ctx is cancelled.
+func (p *selfSignedCertProvider) Run(ctx context.Context) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		timer := time.NewTimer(p.nextRotation())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-sighup:
+			timer.Stop()
+			p.log.Infof("received SIGHUP, rotating serving certificate")
+		case <-timer.C:
+			p.log.Infof("serving certificate approaching expiry, rotating")
+		}
+		if err := p.rotateServingCert(); err != nil {
+			p.log.Errorf("failed to rotate serving certificate: %v", err)
+		}
+	}
+}
+
+// fileCertProvider reloads its serving certificate whenever CertFile or
+// KeyFile change on disk, or on SIGHUP. It is used when the caller supplies
+// its own certificate material instead of relying on chimera to self-sign.
+type fileCertProvider struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	log      Logger
+
+	current atomic.Value // *tls.Certificate
+
+	// onCARotate, if set, is called with the DER-encoded CA certificate
+	// whenever caFile's contents change, so callers can push the new
+	// CABundle onto an already-registered Validating/MutatingWebhookConfiguration
+	// instead of recreating it.
+	onCARotate func(caCertDER []byte)
+}
+
+func newFileCertProvider(certFile, keyFile, caFile string, log Logger) (*fileCertProvider, error) {
+	p := &fileCertProvider{certFile: certFile, keyFile: keyFile, caFile: caFile, log: log}
+	if err := p.reloadServingCert(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *fileCertProvider) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return p.current.Load().(*tls.Certificate), nil
+}
+
+func (p *fileCertProvider) CACertificateDER() []byte {
+	if p.caFile == "" {
+		return nil
+	}
+	der, err := caCertificateDERFromFile(p.caFile)
+	if err != nil {
+		p.log.Errorf("failed to read CA certificate %s: %v", p.caFile, err)
+		return nil
+	}
+	return der
+}
+
+func (p *fileCertProvider) reloadServingCert() error {
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return err
+	}
+	p.current.Store(&cert)
+	return nil
+}
+
+// Run watches CertFile, KeyFile and CaFile for changes and reloads them when
+// rewritten, or immediately on SIGHUP, until ctx is cancelled. A change to
+// CaFile invokes onCARotate instead of reloadServingCert, since the apiserver
+// needs to be told about the new CABundle rather than the local TLS config.
+func (p *fileCertProvider) Run(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		p.log.Errorf("failed to watch certificate files for changes: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	watchedDirs := map[string]bool{}
+	for _, f := range []string{p.certFile, p.keyFile, p.caFile} {
+		if f == "" {
+			continue
+		}
+		dir := filepath.Dir(f)
+		if watchedDirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			p.log.Errorf("failed to watch %s for changes: %v", dir, err)
+			continue
+		}
+		watchedDirs[dir] = true
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		var caChanged, servingChanged bool
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			p.log.Infof("received SIGHUP, reloading certificates from disk")
+			caChanged, servingChanged = true, true
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			switch event.Name {
+			case p.certFile, p.keyFile:
+				servingChanged = true
+			case p.caFile:
+				caChanged = true
+			default:
+				continue
+			}
+			p.log.Infof("%s changed, reloading", event.Name)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			p.log.Errorf("certificate watcher error: %v", err)
+			continue
+		}
+
+		if servingChanged {
+			if err := p.reloadServingCert(); err != nil {
+				p.log.Errorf("failed to reload serving certificate from disk: %v", err)
+			}
+		}
+		if caChanged && p.onCARotate != nil {
+			if der := p.CACertificateDER(); der != nil {
+				p.onCARotate(der)
+			}
+		}
+	}
+}
+
+// certNeedsRotation reports whether the DER-encoded certificate certDER has
+// passed rotateAtFraction of its validity window and should be replaced.
+func certNeedsRotation(certDER []byte) bool {
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return true
+	}
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	rotateAt := cert.NotBefore.Add(time.Duration(float64(lifetime) * rotateAtFraction))
+	return time.Now().After(rotateAt)
+}
+
+func parsePKCS1PrivateKeyPEM(keyPEM []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block containing private key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func leafOf(cert *tls.Certificate) *x509.Certificate {
+	if cert.Leaf != nil {
+		return cert.Leaf
+	}
+	if len(cert.Certificate) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
+
+func caCertificateDERFromFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		// Assume the file is already DER-encoded.
+		return data, nil
+	}
+	return block.Bytes, nil
+}
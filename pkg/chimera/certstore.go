@@ -0,0 +1,228 @@
+package chimera
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	kubeclient "sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// CertMaterial is the CA and serving keypair a CertStore hands back to a
+// CertProvider.
+type CertMaterial struct {
+	CACertDER      []byte // DER-encoded CA certificate
+	CAKeyPEM       []byte // PKCS1 PEM-encoded CA private key
+	ServingCertPEM []byte
+	ServingKeyPEM  []byte
+}
+
+// CertStore provisions the CA and serving keypair a selfSignedCertProvider
+// serves certificates from. It exists so the same certificate material can
+// be shared across multiple replicas of an admission server behind a
+// Service, instead of every replica self-signing its own untrusted CA.
+type CertStore interface {
+	// Load returns existing certificate material. ok is false when there is
+	// none yet, or what's there is expiring soon -- in which case the caller
+	// should generate fresh material and pass it to Save.
+	Load() (material *CertMaterial, ok bool, err error)
+
+	// Save persists newly generated material and returns the material every
+	// replica should actually serve: m itself if this call's write won, or
+	// the material a concurrent caller's Save already committed if it lost
+	// the race.
+	Save(m *CertMaterial) (*CertMaterial, error)
+}
+
+// InMemoryStore never persists anything: Load always reports no material, so
+// the caller generates its own on every rotation. It is the right choice for a single replica, and was chimera's
+// only behavior before CertStore existed.
+type InMemoryStore struct{}
+
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{}
+}
+
+func (*InMemoryStore) Load() (*CertMaterial, bool, error) {
+	return nil, false, nil
+}
+
+func (*InMemoryStore) Save(m *CertMaterial) (*CertMaterial, error) {
+	return m, nil
+}
+
+const (
+	secretKeyCACert      = "ca.crt"
+	secretKeyCAKey       = "ca.key"
+	secretKeyServingCert = "tls.crt"
+	secretKeyServingKey  = "tls.key"
+)
+
+// SecretStore persists the CA and serving keypair in a Kubernetes Secret so
+// every replica behind the same Service loads and serves identical
+// certificates. Concurrent writers are reconciled with an optimistic
+// (resourceVersion-CAS) update: whichever replica's Save is applied first
+// wins, and the rest adopt its material instead of overwriting it.
+type SecretStore struct {
+	namespace string
+	name      string
+	clientset kubernetes.Interface
+}
+
+func NewSecretStore(namespace, name string) (*SecretStore, error) {
+	kubeCfg, err := kubeclient.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(kubeCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretStore{namespace: namespace, name: name, clientset: clientset}, nil
+}
+
+func (s *SecretStore) secrets() corev1client.SecretInterface {
+	return s.clientset.CoreV1().Secrets(s.namespace)
+}
+
+func (s *SecretStore) Load() (*CertMaterial, bool, error) {
+	secret, err := s.secrets().Get(context.TODO(), s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	material, ok := materialFromSecret(secret)
+	if !ok {
+		return nil, false, nil
+	}
+	if materialNeedsRotation(material) {
+		return nil, false, nil
+	}
+	return material, true, nil
+}
+
+// Save performs an optimistic update of the backing Secret: it re-reads the
+// Secret to get the current resourceVersion, writes m if the Secret is still
+// empty/expiring, and -- if a peer updated the Secret first -- returns that
+// peer's material instead of m.
+func (s *SecretStore) Save(m *CertMaterial) (*CertMaterial, error) {
+	secrets := s.secrets()
+
+	secret, err := secrets.Get(context.TODO(), s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: s.namespace,
+				Name:      s.name,
+			},
+			Type: corev1.SecretTypeOpaque,
+		}
+		var dataErr error
+		secret.Data, dataErr = materialToSecretData(m)
+		if dataErr != nil {
+			return nil, dataErr
+		}
+		_, err := secrets.Create(context.TODO(), secret, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return s.adoptCurrent()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if existing, ok := materialFromSecret(secret); ok && !materialNeedsRotation(existing) {
+		return existing, nil
+	}
+
+	var dataErr error
+	secret.Data, dataErr = materialToSecretData(m)
+	if dataErr != nil {
+		return nil, dataErr
+	}
+	_, err = secrets.Update(context.TODO(), secret, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		return s.adoptCurrent()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// adoptCurrent re-reads the Secret after losing a create/update race and
+// returns whatever material the winner committed.
+func (s *SecretStore) adoptCurrent() (*CertMaterial, error) {
+	secret, err := s.secrets().Get(context.TODO(), s.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	material, ok := materialFromSecret(secret)
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no usable certificate material after losing the write race", s.namespace, s.name)
+	}
+	return material, nil
+}
+
+// materialNeedsRotation reports whether either the CA or the serving
+// certificate in m has passed rotateAtFraction of its validity window. The
+// CA is valid far longer than the serving certificate (caValidity vs.
+// generateCert's one-year window), so checking only the CA would leave an
+// expiring serving certificate in place indefinitely.
+func materialNeedsRotation(m *CertMaterial) bool {
+	if certNeedsRotation(m.CACertDER) {
+		return true
+	}
+	block, _ := pem.Decode(m.ServingCertPEM)
+	if block == nil {
+		return true
+	}
+	return certNeedsRotation(block.Bytes)
+}
+
+func materialToSecretData(m *CertMaterial) (map[string][]byte, error) {
+	caCertPEM, err := pemEncodeCertificate(m.CACertDER)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		secretKeyCACert:      caCertPEM,
+		secretKeyCAKey:       m.CAKeyPEM,
+		secretKeyServingCert: m.ServingCertPEM,
+		secretKeyServingKey:  m.ServingKeyPEM,
+	}, nil
+}
+
+func materialFromSecret(secret *corev1.Secret) (*CertMaterial, bool) {
+	caCertPEM := secret.Data[secretKeyCACert]
+	caKeyPEM := secret.Data[secretKeyCAKey]
+	servingCertPEM := secret.Data[secretKeyServingCert]
+	servingKeyPEM := secret.Data[secretKeyServingKey]
+	if len(caCertPEM) == 0 || len(caKeyPEM) == 0 || len(servingCertPEM) == 0 || len(servingKeyPEM) == 0 {
+		return nil, false
+	}
+
+	block, _ := pem.Decode(caCertPEM)
+	if block == nil {
+		return nil, false
+	}
+
+	return &CertMaterial{
+		CACertDER:      block.Bytes,
+		CAKeyPEM:       caKeyPEM,
+		ServingCertPEM: servingCertPEM,
+		ServingKeyPEM:  servingKeyPEM,
+	}, true
+}
@@ -0,0 +1,153 @@
+package chimera
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testCert generates a self-signed certificate valid from notBefore to
+// notAfter, returning its DER encoding and private key.
+func testCert(t *testing.T, notBefore, notAfter time.Time) ([]byte, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	return der, key
+}
+
+func TestCertNeedsRotation(t *testing.T) {
+	now := time.Now()
+
+	fresh, _ := testCert(t, now, now.Add(time.Hour))
+	if certNeedsRotation(fresh) {
+		t.Error("freshly issued certificate should not need rotation")
+	}
+
+	expiring, _ := testCert(t, now.Add(-8*time.Minute), now.Add(2*time.Minute))
+	if !certNeedsRotation(expiring) {
+		t.Error("certificate past rotateAtFraction of its lifetime should need rotation")
+	}
+}
+
+func TestMaterialNeedsRotation(t *testing.T) {
+	now := time.Now()
+	caDER, caKey := testCert(t, now, now.Add(caValidity))
+	caKeyPEM, err := pemEncodePrivateKey(x509.MarshalPKCS1PrivateKey(caKey))
+	if err != nil {
+		t.Fatalf("failed to PEM-encode CA key: %v", err)
+	}
+
+	freshServingDER, servingKey := testCert(t, now, now.Add(time.Hour))
+	freshServingPEM, err := pemEncodeCertificate(freshServingDER)
+	if err != nil {
+		t.Fatalf("failed to PEM-encode serving cert: %v", err)
+	}
+	servingKeyPEM, err := pemEncodePrivateKey(x509.MarshalPKCS1PrivateKey(servingKey))
+	if err != nil {
+		t.Fatalf("failed to PEM-encode serving key: %v", err)
+	}
+
+	fresh := &CertMaterial{
+		CACertDER:      caDER,
+		CAKeyPEM:       caKeyPEM,
+		ServingCertPEM: freshServingPEM,
+		ServingKeyPEM:  servingKeyPEM,
+	}
+	if materialNeedsRotation(fresh) {
+		t.Error("material with a fresh CA and serving cert should not need rotation")
+	}
+
+	expiringServingDER, _ := testCert(t, now.Add(-8*time.Minute), now.Add(2*time.Minute))
+	expiringServingPEM, err := pemEncodeCertificate(expiringServingDER)
+	if err != nil {
+		t.Fatalf("failed to PEM-encode expiring serving cert: %v", err)
+	}
+
+	// The CA here is nowhere near expiry, but the serving certificate is --
+	// this is the case that broke SecretStore.Load/Save: a long-lived CA
+	// masked an expiring serving certificate.
+	staleServing := &CertMaterial{
+		CACertDER:      caDER,
+		CAKeyPEM:       caKeyPEM,
+		ServingCertPEM: expiringServingPEM,
+		ServingKeyPEM:  servingKeyPEM,
+	}
+	if !materialNeedsRotation(staleServing) {
+		t.Error("material with a fresh CA but an expiring serving cert should need rotation")
+	}
+}
+
+func TestSecretStoreLoad_ExpiringServingCertNeedsRotation(t *testing.T) {
+	now := time.Now()
+	caDER, caKey := testCert(t, now, now.Add(caValidity))
+	caKeyPEM, err := pemEncodePrivateKey(x509.MarshalPKCS1PrivateKey(caKey))
+	if err != nil {
+		t.Fatalf("failed to PEM-encode CA key: %v", err)
+	}
+	expiringServingDER, servingKey := testCert(t, now.Add(-8*time.Minute), now.Add(2*time.Minute))
+	expiringServingPEM, err := pemEncodeCertificate(expiringServingDER)
+	if err != nil {
+		t.Fatalf("failed to PEM-encode serving cert: %v", err)
+	}
+	servingKeyPEM, err := pemEncodePrivateKey(x509.MarshalPKCS1PrivateKey(servingKey))
+	if err != nil {
+		t.Fatalf("failed to PEM-encode serving key: %v", err)
+	}
+
+	material := &CertMaterial{
+		CACertDER:      caDER,
+		CAKeyPEM:       caKeyPEM,
+		ServingCertPEM: expiringServingPEM,
+		ServingKeyPEM:  servingKeyPEM,
+	}
+	data, err := materialToSecretData(material)
+	if err != nil {
+		t.Fatalf("failed to build secret data: %v", err)
+	}
+
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "certs"},
+		Data:       data,
+	})
+	store := &SecretStore{namespace: "ns", name: "certs", clientset: clientset}
+
+	_, ok, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load returned an error: %v", err)
+	}
+	if ok {
+		t.Error("Load should report ok=false when the serving certificate needs rotation, even with a long-lived CA")
+	}
+
+	secret, err := clientset.CoreV1().Secrets("ns").Get(context.TODO(), "certs", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch secret: %v", err)
+	}
+	if _, ok := materialFromSecret(secret); !ok {
+		t.Error("expected the stale secret to still decode, just be reported as needing rotation")
+	}
+}
@@ -0,0 +1,65 @@
+package chimera
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// ClientAuthConfig enforces mutual TLS on incoming admission requests: the
+// caller must present a client certificate signed by CAFile/CAData, and that
+// certificate's CommonName must appear in AllowedCommonNames -- typically
+// just the apiserver's own client identity (commonly "kube-apiserver").
+//
+// The apiserver side of this trust relationship is configured independently,
+// by pointing its --admission-control-config-file AdmissionConfiguration at
+// a client certificate signed by the same CA referenced here.
+type ClientAuthConfig struct {
+	CAFile             string // +optional, mutually exclusive with CAData
+	CAData             []byte // +optional, mutually exclusive with CAFile
+	AllowedCommonNames []string
+}
+
+func (c *ClientAuthConfig) certPool() (*x509.CertPool, error) {
+	caData := c.CAData
+	if c.CAFile != "" {
+		data, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		caData = data
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle")
+	}
+	return pool, nil
+}
+
+func (c *ClientAuthConfig) commonNameAllowed(commonName string) bool {
+	for _, allowed := range c.AllowedCommonNames {
+		if allowed == commonName {
+			return true
+		}
+	}
+	return false
+}
+
+// requireClientCommonName wraps next so a request is rejected with 401
+// unless it carries a client certificate, verified by the server's
+// tls.Config.ClientCAs, whose CommonName is in AllowedCommonNames.
+func (c *ClientAuthConfig) requireClientCommonName(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			http.Error(w, "a verified client certificate is required", http.StatusUnauthorized)
+			return
+		}
+		commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if !c.commonNameAllowed(commonName) {
+			http.Error(w, fmt.Sprintf("client certificate CommonName %q is not permitted", commonName), http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
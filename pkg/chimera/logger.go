@@ -1,6 +1,7 @@
 package chimera
 
 import (
+	"context"
 	"fmt"
 	"log"
 )
@@ -14,6 +15,88 @@ type Logger interface {
 	Errorf(format string, args ...interface{})
 }
 
+// FieldLogger is an optional extension of Logger: a Logger that also
+// implements it is asked to scope itself directly (for example to attach
+// fields as structured data instead of a formatted prefix). Loggers that
+// don't implement it are wrapped in a generic decorator instead, so adding
+// FieldLogger support is opt-in and never breaks an existing Logger
+// implementation.
+type FieldLogger interface {
+	Logger
+	WithFields(fields map[string]interface{}) Logger
+}
+
+type loggerContextKey struct{}
+
+// ContextWithLogger returns a copy of ctx carrying log, retrievable with
+// LoggerFromContext. BuildHandler uses this to hand a WebhookCallbackWithContext
+// a logger already scoped to the request it's handling.
+func ContextWithLogger(ctx context.Context, log Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, log)
+}
+
+// LoggerFromContext returns the Logger attached to ctx by ContextWithLogger,
+// or a default simpleLogger if none was attached.
+func LoggerFromContext(ctx context.Context) Logger {
+	if log, ok := ctx.Value(loggerContextKey{}).(Logger); ok {
+		return log
+	}
+	return &simpleLogger{}
+}
+
+// requestScopedLoggerWithFields scopes log to fields: directly, if log
+// implements FieldLogger, or by wrapping it in a generic decorator that
+// prepends fields to every message otherwise.
+func requestScopedLoggerWithFields(log Logger, fields map[string]interface{}) Logger {
+	if fl, ok := log.(FieldLogger); ok {
+		return fl.WithFields(fields)
+	}
+	return &fieldLogger{inner: log, fields: fields}
+}
+
+// fieldLogger decorates an arbitrary Logger, prepending fields to every
+// message as "key=value" pairs, so any Logger implementation can be given
+// request-scoped fields without needing to implement FieldLogger itself.
+type fieldLogger struct {
+	inner  Logger
+	fields map[string]interface{}
+}
+
+func (l *fieldLogger) prefix(msg string) string {
+	if len(l.fields) == 0 {
+		return msg
+	}
+	prefix := ""
+	for k, v := range l.fields {
+		prefix += fmt.Sprintf("%s=%v ", k, v)
+	}
+	return prefix + msg
+}
+
+func (l *fieldLogger) Debug(msg string) { l.inner.Debug(l.prefix(msg)) }
+func (l *fieldLogger) Debugf(format string, args ...interface{}) {
+	l.inner.Debug(l.prefix(fmt.Sprintf(format, args...)))
+}
+func (l *fieldLogger) Info(msg string) { l.inner.Info(l.prefix(msg)) }
+func (l *fieldLogger) Infof(format string, args ...interface{}) {
+	l.inner.Info(l.prefix(fmt.Sprintf(format, args...)))
+}
+func (l *fieldLogger) Error(msg string) { l.inner.Error(l.prefix(msg)) }
+func (l *fieldLogger) Errorf(format string, args ...interface{}) {
+	l.inner.Error(l.prefix(fmt.Sprintf(format, args...)))
+}
+
+func (l *fieldLogger) WithFields(fields map[string]interface{}) Logger {
+	merged := make(map[string]interface{}, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &fieldLogger{inner: l.inner, fields: merged}
+}
+
 type simpleLogger struct{}
 
 func (*simpleLogger) Debug(msg string) {
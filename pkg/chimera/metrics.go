@@ -0,0 +1,52 @@
+package chimera
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds the Prometheus collectors BuildHandler records admission
+// outcomes into when AdmissionConfig.MetricsRegistry is set. A nil *metrics
+// is valid and every method is a no-op, so callers don't need to guard each
+// call site on whether metrics are enabled.
+type metrics struct {
+	requestsTotal   *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	errorsTotal     *prometheus.CounterVec
+}
+
+func newMetrics(registry prometheus.Registerer) *metrics {
+	m := &metrics{
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chimera_admission_requests_total",
+			Help: "Total number of admission requests handled, by webhook, operation, and outcome.",
+		}, []string{"webhook", "operation", "allowed"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "chimera_admission_request_duration_seconds",
+			Help: "Latency of admission requests, by webhook and operation.",
+		}, []string{"webhook", "operation"}),
+		errorsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chimera_admission_errors_total",
+			Help: "Total number of admission requests that failed to process, by webhook and error kind.",
+		}, []string{"webhook", "kind"}),
+	}
+	registry.MustRegister(m.requestsTotal, m.requestDuration, m.errorsTotal)
+	return m
+}
+
+func (m *metrics) observeRequest(webhook, operation string, allowed bool, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requestsTotal.WithLabelValues(webhook, operation, strconv.FormatBool(allowed)).Inc()
+	m.requestDuration.WithLabelValues(webhook, operation).Observe(duration.Seconds())
+}
+
+func (m *metrics) observeError(webhook, kind string) {
+	if m == nil {
+		return
+	}
+	m.errorsTotal.WithLabelValues(webhook, kind).Inc()
+}
@@ -1,13 +1,21 @@
 package chimera
 
 import (
+	"encoding/json"
+	"strings"
+
 	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type WebhookResponse struct {
 	Allowed          bool
 	Code             *int32
 	RejectionMessage *string
+	Reason           metav1.StatusReason
+	Details          *metav1.StatusDetails
+	Warnings         []string
+	AuditAnnotations map[string]string
 }
 
 func NewAllowRequest() WebhookResponse {
@@ -43,3 +51,174 @@ func (r WebhookResponse) WithMessage(message string) WebhookResponse {
 	}
 	return r
 }
+
+// WithReason sets the machine-readable reason surfaced on a rejection's
+// Result, e.g. metav1.StatusReasonForbidden. It is a no-op when the request
+// was allowed, since an allowed request has nothing to explain.
+func (r WebhookResponse) WithReason(reason metav1.StatusReason) WebhookResponse {
+	if !r.Allowed {
+		r.Reason = reason
+	}
+	return r
+}
+
+// WithWarning appends a warning to be surfaced to the caller, e.g. by
+// kubectl, regardless of whether the request was allowed or rejected.
+func (r WebhookResponse) WithWarning(warning string) WebhookResponse {
+	r.Warnings = append(r.Warnings, warning)
+	return r
+}
+
+// WithAuditAnnotation attaches an audit annotation that the apiserver
+// records on the request's audit event, regardless of whether the request
+// was allowed or rejected.
+func (r WebhookResponse) WithAuditAnnotation(key, value string) WebhookResponse {
+	if r.AuditAnnotations == nil {
+		r.AuditAnnotations = map[string]string{}
+	}
+	r.AuditAnnotations[key] = value
+	return r
+}
+
+// PatchOp is a single RFC 6902 JSON Patch operation. Path and From are plain
+// JSON Pointers (RFC 6901); use PatchPath to build one from segments that may
+// contain "~" or "/" instead of hand-assembling it.
+type PatchOp struct {
+	Op    string
+	Path  string
+	Value interface{}
+	From  string
+}
+
+// MarshalJSON emits only the members RFC 6902 defines for Op: add/replace/test
+// always carry a "value" member, even an explicit JSON null, so
+// PatchAdd(path, nil) produces a spec-valid patch instead of silently
+// dropping "value" the way a struct tagged `json:"value,omitempty"` would.
+func (p PatchOp) MarshalJSON() ([]byte, error) {
+	switch p.Op {
+	case "add", "replace", "test":
+		return json.Marshal(struct {
+			Op    string      `json:"op"`
+			Path  string      `json:"path"`
+			Value interface{} `json:"value"`
+		}{p.Op, p.Path, p.Value})
+	case "copy", "move":
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			From string `json:"from"`
+			Path string `json:"path"`
+		}{p.Op, p.From, p.Path})
+	default: // "remove"
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{p.Op, p.Path})
+	}
+}
+
+// PatchPath joins segments into an RFC 6901 JSON Pointer, escaping each
+// segment's literal "~" and "/" (as "~0" and "~1") so a segment taken from
+// user data -- an annotation key, say -- can't be mistaken for a path
+// separator or corrupt the pointer.
+func PatchPath(segments ...string) string {
+	escaped := make([]string, len(segments))
+	for i, s := range segments {
+		s = strings.ReplaceAll(s, "~", "~0")
+		s = strings.ReplaceAll(s, "/", "~1")
+		escaped[i] = s
+	}
+	return "/" + strings.Join(escaped, "/")
+}
+
+// PatchAdd builds an RFC 6902 "add" operation.
+func PatchAdd(path string, value interface{}) PatchOp {
+	return PatchOp{Op: "add", Path: path, Value: value}
+}
+
+// PatchRemove builds an RFC 6902 "remove" operation.
+func PatchRemove(path string) PatchOp {
+	return PatchOp{Op: "remove", Path: path}
+}
+
+// PatchReplace builds an RFC 6902 "replace" operation.
+func PatchReplace(path string, value interface{}) PatchOp {
+	return PatchOp{Op: "replace", Path: path, Value: value}
+}
+
+// PatchCopy builds an RFC 6902 "copy" operation.
+func PatchCopy(from string, path string) PatchOp {
+	return PatchOp{Op: "copy", From: from, Path: path}
+}
+
+// PatchMove builds an RFC 6902 "move" operation.
+func PatchMove(from string, path string) PatchOp {
+	return PatchOp{Op: "move", From: from, Path: path}
+}
+
+// PatchTest builds an RFC 6902 "test" operation.
+func PatchTest(path string, value interface{}) PatchOp {
+	return PatchOp{Op: "test", Path: path, Value: value}
+}
+
+// MutatingResponse is the result of a MutatingWebhookCallback. It carries the
+// same allow/reject semantics as WebhookResponse plus an optional JSONPatch
+// describing how the admitted object should be changed.
+type MutatingResponse struct {
+	WebhookResponse
+	Patch []PatchOp
+}
+
+func NewAllowMutatingRequest() MutatingResponse {
+	return MutatingResponse{
+		WebhookResponse: NewAllowRequest(),
+	}
+}
+
+func AllowMutatingRequest(*admissionv1.AdmissionRequest) (MutatingResponse, error) {
+	return NewAllowMutatingRequest(), nil
+}
+
+func NewRejectMutatingRequest() MutatingResponse {
+	return MutatingResponse{
+		WebhookResponse: NewRejectRequest(),
+	}
+}
+
+func RejectMutatingRequest(*admissionv1.AdmissionRequest) (MutatingResponse, error) {
+	return NewRejectMutatingRequest(), nil
+}
+
+func (r MutatingResponse) WithCode(code int32) MutatingResponse {
+	r.WebhookResponse = r.WebhookResponse.WithCode(code)
+	return r
+}
+
+func (r MutatingResponse) WithMessage(message string) MutatingResponse {
+	r.WebhookResponse = r.WebhookResponse.WithMessage(message)
+	return r
+}
+
+func (r MutatingResponse) WithReason(reason metav1.StatusReason) MutatingResponse {
+	r.WebhookResponse = r.WebhookResponse.WithReason(reason)
+	return r
+}
+
+func (r MutatingResponse) WithWarning(warning string) MutatingResponse {
+	r.WebhookResponse = r.WebhookResponse.WithWarning(warning)
+	return r
+}
+
+func (r MutatingResponse) WithAuditAnnotation(key, value string) MutatingResponse {
+	r.WebhookResponse = r.WebhookResponse.WithAuditAnnotation(key, value)
+	return r
+}
+
+// WithPatch appends RFC 6902 JSON Patch operations to the response. It is a
+// no-op when the request was rejected, since a rejected request is never
+// patched.
+func (r MutatingResponse) WithPatch(ops ...PatchOp) MutatingResponse {
+	if r.Allowed {
+		r.Patch = append(r.Patch, ops...)
+	}
+	return r
+}
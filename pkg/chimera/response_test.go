@@ -0,0 +1,48 @@
+package chimera
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPatchOpMarshalJSON_ExplicitNullValue(t *testing.T) {
+	data, err := json.Marshal(PatchAdd("/metadata/labels/foo", nil))
+	if err != nil {
+		t.Fatalf("failed to marshal patch op: %v", err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal marshaled patch op: %v", err)
+	}
+	value, ok := decoded["value"]
+	if !ok {
+		t.Fatalf("expected \"value\" to be present for an add op, got %s", data)
+	}
+	if value != nil {
+		t.Errorf("expected \"value\" to be JSON null, got %v", value)
+	}
+}
+
+func TestPatchOpMarshalJSON_RemoveHasNoValue(t *testing.T) {
+	data, err := json.Marshal(PatchRemove("/metadata/labels/foo"))
+	if err != nil {
+		t.Fatalf("failed to marshal patch op: %v", err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal marshaled patch op: %v", err)
+	}
+	if _, ok := decoded["value"]; ok {
+		t.Errorf("expected \"value\" to be absent for a remove op, got %s", data)
+	}
+}
+
+func TestPatchPath(t *testing.T) {
+	got := PatchPath("metadata", "annotations", "example.com/a~b")
+	want := "/metadata/annotations/example.com~1a~0b"
+	if got != want {
+		t.Errorf("PatchPath() = %q, want %q", got, want)
+	}
+}